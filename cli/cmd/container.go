@@ -0,0 +1,26 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import "github.com/chaosblade-io/chaosblade/data"
+
+// updatePreparationContainer persists the container id and resolved host pid
+// for uid, so a later prepare/destroy against the same uid knows to re-enter
+// the container's namespaces.
+func updatePreparationContainer(uid, containerId, hostPid string) error {
+	return data.UpdatePreparationContainer(uid, containerId, hostPid)
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// envFallback walks cmd's flags after cobra has parsed args and, for every flag
+// named in mapping that was left unset on the command line, fills it from the
+// mapped CHAOSBLADE_* environment variable. A subcommand registers it as a
+// PreRunE with its own flag->env mapping, which is far easier than a wrapper
+// shell script per flag when launching blade from a container entrypoint, a
+// Kubernetes pod or a CI job.
+//
+// PrepareJvmCommand is the only baseCommand subclass wired to it so far
+// (jvmEnvFlagMapping); this checkout doesn't contain the other prepare/create
+// subcommands, so extending env fallback to them is left to whoever adds
+// those files rather than done here speculatively.
+func envFallback(cmd *cobra.Command, mapping map[string]string) error {
+	for flagName, envKey := range mapping {
+		flag := cmd.Flags().Lookup(flagName)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		value, ok := os.LookupEnv(envKey)
+		if !ok || value == "" {
+			continue
+		}
+		if err := flag.Value.Set(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
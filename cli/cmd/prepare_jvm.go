@@ -23,6 +23,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/chaosblade-io/chaosblade-spec-go/channel"
@@ -33,10 +34,107 @@ import (
 
 	"github.com/chaosblade-io/chaosblade/data"
 	"github.com/chaosblade-io/chaosblade/exec/jvm"
+	"github.com/chaosblade-io/chaosblade/exec/report"
 )
 
+// startReportFlusherOnce ensures the background flusher that drains
+// undelivered attach result reports (left behind by a previous blade process)
+// is only started once per process, regardless of how many times Init runs.
+var startReportFlusherOnce sync.Once
+
+const reportFlushInterval = 30 * time.Second
+
+// jvmEnvFlagMapping maps PrepareJvmCommand flags to the CHAOSBLADE_* env vars
+// that can fill them in when left unset on the command line.
+var jvmEnvFlagMapping = map[string]string{
+	"javaHome": "CHAOSBLADE_JVM_JAVA_HOME",
+	"process":  "CHAOSBLADE_JVM_PROCESS",
+	"pid":      "CHAOSBLADE_JVM_PID",
+	"port":     "CHAOSBLADE_JVM_PORT",
+	"async":    "CHAOSBLADE_ASYNC",
+	"endpoint": "CHAOSBLADE_ENDPOINT",
+}
+
+// JvmAttacher abstracts the exec/jvm operations PrepareJvmCommand depends on, so
+// the command can be unit tested without a real JVM process to attach to.
+type JvmAttacher interface {
+	// ResolvePID validates the process/pid (and, when containerId is set, container) flags
+	// and returns the host pid to attach to.
+	ResolvePID(processName, processId, containerRuntime, containerId string) (string, *spec.Response)
+	// Attach attaches the sandbox agent to pid, listening on port, and returns the OS user owning the process.
+	Attach(port, javaHome, pid string) (response *spec.Response, username string)
+	// CheckPort looks up the sandbox port already bound for username from ~/.sandbox.token.
+	CheckPort(username string) (string, error)
+	// AttachContainer attaches the sandbox agent to hostPid from inside containerId's
+	// namespaces, falling back to the sandbox-token port (persisted via updatePort) on
+	// connection refused the same way Attach does for the non-container path.
+	AttachContainer(containerRuntime, containerId, port, javaHome, hostPid, uid string, updatePort func(uid, port string) error) *spec.Response
+}
+
+// PreparationStore abstracts the data store operations PrepareJvmCommand depends
+// on, so the command can be unit tested without a real sqlite file.
+type PreparationStore interface {
+	Query(preType, processName, processId string) (*data.PreparationRecord, error)
+	Insert(preType, processName, port, processId string) (*data.PreparationRecord, error)
+	UpdatePort(uid, port string) error
+	UpdatePid(uid, processId string) error
+	UpdateContainer(uid, containerId, processId string) error
+	QueryByUid(uid string) (*data.PreparationRecord, error)
+}
+
+type defaultJvmAttacher struct{}
+
+func (defaultJvmAttacher) ResolvePID(processName, processId, containerRuntime, containerId string) (string, *spec.Response) {
+	if containerId != "" {
+		return jvm.CheckContainerFlagValues(containerRuntime, containerId, processName, processId)
+	}
+	return jvm.CheckFlagValues(processName, processId)
+}
+
+func (defaultJvmAttacher) Attach(port, javaHome, pid string) (*spec.Response, string) {
+	return jvm.Attach(port, javaHome, pid)
+}
+
+func (defaultJvmAttacher) CheckPort(username string) (string, error) {
+	return jvm.CheckPortFromSandboxToken(username)
+}
+
+func (defaultJvmAttacher) AttachContainer(containerRuntime, containerId, port, javaHome, hostPid, uid string, updatePort func(uid, port string) error) *spec.Response {
+	return jvm.AttachInContainer(containerRuntime, containerId, port, javaHome, hostPid, uid, updatePort)
+}
+
+type dataPreparationStore struct{}
+
+func (dataPreparationStore) Query(preType, processName, processId string) (*data.PreparationRecord, error) {
+	return GetDS().QueryRunningPreByTypeAndProcess(preType, processName, processId)
+}
+
+func (dataPreparationStore) Insert(preType, processName, port, processId string) (*data.PreparationRecord, error) {
+	return insertPrepareRecord(preType, processName, port, processId)
+}
+
+func (dataPreparationStore) UpdatePort(uid, port string) error {
+	return updatePreparationPort(uid, port)
+}
+
+func (dataPreparationStore) UpdatePid(uid, processId string) error {
+	return updatePreparationPid(uid, processId)
+}
+
+func (dataPreparationStore) UpdateContainer(uid, containerId, processId string) error {
+	return updatePreparationContainer(uid, containerId, processId)
+}
+
+func (dataPreparationStore) QueryByUid(uid string) (*data.PreparationRecord, error) {
+	return GetDS().QueryPreparationByUid(uid)
+}
+
 type PrepareJvmCommand struct {
 	baseCommand
+	// attacher performs the actual jvm attach, defaulting to defaultJvmAttacher; tests inject a mock
+	attacher JvmAttacher
+	// store persists preparation records, defaulting to dataPreparationStore; tests inject a mock
+	store       PreparationStore
 	javaHome    string
 	processName string
 	// sandboxHome is jvm-sandbox home, default value is CHAOSBLADE_HOME/lib
@@ -52,13 +150,42 @@ type PrepareJvmCommand struct {
 	// Actively report the attach result.
 	// The installation result report is triggered only when the async value is true and the value is not empty.
 	endpoint string
+	// containerId is the target container id or name when the java process runs inside a container
+	containerId string
+	// containerRuntime is the container runtime used to resolve and enter the container, docker or containerd
+	containerRuntime string
+	// endpointSecret signs the attach result report with HMAC-SHA256 so the receiver can authenticate it
+	endpointSecret string
+	// endpointMaxRetries is the number of retries, with exponential backoff, for delivering the attach result report
+	endpointMaxRetries int
+	// endpointTimeout is the per-attempt timeout for delivering the attach result report
+	endpointTimeout time.Duration
+}
+
+// NewPrepareJvmCommand creates a PrepareJvmCommand wired to the real jvm attach
+// backend and data store. Tests construct a PrepareJvmCommand directly and set
+// attacher/store to mocks instead of calling this.
+func NewPrepareJvmCommand() *PrepareJvmCommand {
+	return &PrepareJvmCommand{
+		attacher: defaultJvmAttacher{},
+		store:    dataPreparationStore{},
+	}
 }
 
 func (pc *PrepareJvmCommand) Init() {
+	if pc.attacher == nil {
+		pc.attacher = defaultJvmAttacher{}
+	}
+	if pc.store == nil {
+		pc.store = dataPreparationStore{}
+	}
 	pc.command = &cobra.Command{
 		Use:   "jvm",
 		Short: "Attach a type agent to the jvm process",
 		Long:  "Attach a type agent to the jvm process for java framework experiment.",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return envFallback(cmd, jvmEnvFlagMapping)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return pc.prepareJvm()
 		},
@@ -72,7 +199,16 @@ func (pc *PrepareJvmCommand) Init() {
 	pc.command.Flags().StringVarP(&pc.uid, "uid", "u", "", "used to internal async attach, no need to config")
 	pc.command.Flags().BoolVarP(&pc.nohup, "nohup", "n", false, "used to internal async attach, no need to config")
 	pc.command.Flags().StringVarP(&pc.endpoint, "endpoint", "e", "", "the attach result reporting address. It takes effect only when the async value is true and the value is not empty")
+	pc.command.Flags().StringVarP(&pc.containerId, "container", "c", "", "the target container id or name, used when the java process runs inside a container")
+	pc.command.Flags().StringVarP(&pc.containerRuntime, "container-runtime", "", "docker", "the container runtime used to resolve the container, supports docker and containerd")
+	pc.command.Flags().StringVarP(&pc.endpointSecret, "endpoint-secret", "", "", "the shared secret used to HMAC-sign the attach result report, falls back to the CHAOSBLADE_ENDPOINT_SECRET env var")
+	pc.command.Flags().IntVarP(&pc.endpointMaxRetries, "endpoint-max-retries", "", 5, "the number of retries, with exponential backoff, for delivering the attach result report")
+	pc.command.Flags().DurationVarP(&pc.endpointTimeout, "endpoint-timeout", "", 10*time.Second, "the per-attempt timeout for delivering the attach result report")
 	pc.sandboxHome = path.Join(util.GetLibHome(), "sandbox")
+	// drain any attach result reports a previous blade process left undelivered
+	startReportFlusherOnce.Do(func() {
+		report.StartFlusher(reportFlushInterval)
+	})
 }
 
 func (pc *PrepareJvmCommand) prepareExample() string {
@@ -85,12 +221,12 @@ func (pc *PrepareJvmCommand) prepareJvm() error {
 		return spec.ReturnFail(spec.Code[spec.IllegalParameters],
 			fmt.Sprintf("less --process or --pid flags"))
 	}
-	pid, response := jvm.CheckFlagValues(pc.processName, pc.processId)
+	pid, response := pc.attacher.ResolvePID(pc.processName, pc.processId, pc.containerRuntime, pc.containerId)
 	if !response.Success {
 		return response
 	}
 	pc.processId = pid
-	record, err := GetDS().QueryRunningPreByTypeAndProcess(PrepareJvmType, pc.processName, pc.processId)
+	record, err := pc.store.Query(PrepareJvmType, pc.processName, pc.processId)
 	if err != nil {
 		return spec.ReturnFail(spec.Code[spec.DatabaseError],
 			fmt.Sprintf("query attach java process record err, %s", err.Error()))
@@ -113,7 +249,15 @@ func (pc *PrepareJvmCommand) prepareJvm() error {
 	response = pc.attachAgent()
 	if record != nil && record.Pid != pc.processId {
 		// update pid
-		updatePreparationPid(pc.uid, pc.processId)
+		pc.store.UpdatePid(pc.uid, pc.processId)
+	}
+	if pc.containerId != "" {
+		// persist the container id and the resolved host pid so future prepare/destroy
+		// operations against this uid know to re-enter the container namespace; this is
+		// an upsert, so it's safe to call on every prepare rather than diffing the record
+		if err := pc.store.UpdateContainer(pc.uid, pc.containerId, pc.processId); err != nil {
+			logrus.Warningf("update preparation container info failed, %v", err)
+		}
 	}
 
 	preErr := handlePrepareResponseWithoutExit(pc.uid, pc.command, response)
@@ -127,35 +271,46 @@ func (pc *PrepareJvmCommand) prepareJvm() error {
 	return preErr
 }
 
+// reportAttachedResult delivers the attach result to pc.endpoint via the shared
+// report subsystem, which retries with backoff, signs the body and persists it
+// until delivered so the result isn't lost if the endpoint is briefly unreachable.
+// Deliver persists the report before returning, so the report survives even if
+// this process exits (e.g. the --nohup child) right after prepareJvm returns;
+// only the network retries themselves continue in the background.
 func (pc *PrepareJvmCommand) reportAttachedResult(response *spec.Response) {
 	logrus.Infof("report response: %s to endpoint: %s", response.Print(), pc.endpoint)
-	body, err := createPostBody(pc.uid)
+	body, err := pc.createPostBody(pc.uid)
 	if err != nil {
 		logrus.Warningf("create java install post body %s failed, %v", response.Print(), err)
-	} else {
-		result, err, code := util.PostCurl(pc.endpoint, body, "application/json")
-		if err != nil {
-			logrus.Warningf("report java install result %s failed, %v", response.Print(), err)
-		} else if code != 200 {
-			logrus.Warningf("response code is %d, result %s", code, result)
-		} else {
-			logrus.Infof("report java install result success, result %s", result)
-		}
+		return
 	}
+	reporter := report.NewReporter(report.Config{
+		Endpoint:   pc.endpoint,
+		Secret:     pc.endpointSecret,
+		MaxRetries: pc.endpointMaxRetries,
+		Timeout:    pc.endpointTimeout,
+	})
+	reporter.Deliver(pc.uid, body)
 }
 
-// attachAgent
+// attachAgent attaches the sandbox agent to the already resolved pc.processId,
+// entering the container's mount and pid namespaces first when --container is set,
+// so the attach runs and the agent socket is created inside the container's
+// filesystem rather than the host's.
 func (pc *PrepareJvmCommand) attachAgent() *spec.Response {
-	response, username := jvm.Attach(strconv.Itoa(pc.port), pc.javaHome, pc.processId)
+	if pc.containerId != "" {
+		return pc.attacher.AttachContainer(pc.containerRuntime, pc.containerId, strconv.Itoa(pc.port), pc.javaHome, pc.processId, pc.uid, pc.store.UpdatePort)
+	}
+	response, username := pc.attacher.Attach(strconv.Itoa(pc.port), pc.javaHome, pc.processId)
 	if !response.Success && username != "" && strings.Contains(response.Err, "connection refused") {
 		// if attach failed, search port from ~/.sandbox.token
-		port, err := jvm.CheckPortFromSandboxToken(username)
+		port, err := pc.attacher.CheckPort(username)
 		if err == nil {
 			logrus.Infof("use %s port to retry", port)
-			response, username = jvm.Attach(port, pc.javaHome, pc.processId)
+			response, username = pc.attacher.Attach(port, pc.javaHome, pc.processId)
 			if response.Success {
 				// update port
-				err := updatePreparationPort(pc.uid, port)
+				err := pc.store.UpdatePort(pc.uid, port)
 				if err != nil {
 					logrus.Warningf("update preparation port failed, %v", err)
 				}
@@ -179,7 +334,7 @@ func (pc *PrepareJvmCommand) ManualPreparation(record *data.PreparationRecord, e
 					fmt.Sprintf("get sandbox port err, %s", err.Error()))
 			}
 		}
-		record, err = insertPrepareRecord(PrepareJvmType, pc.processName, port, pc.processId)
+		record, err = pc.store.Insert(PrepareJvmType, pc.processName, port, pc.processId)
 		if err != nil {
 			return nil, spec.ReturnFail(spec.Code[spec.DatabaseError],
 				fmt.Sprintf("insert prepare record err, %s", err.Error()))
@@ -222,6 +377,16 @@ func (pc *PrepareJvmCommand) invokeAttaching(port string, uid string) {
 	if pc.endpoint != "" {
 		args = fmt.Sprintf("%s --endpoint %s", args, pc.endpoint)
 	}
+	if pc.containerId != "" {
+		args = fmt.Sprintf("%s --container %s --container-runtime %s", args, pc.containerId, pc.containerRuntime)
+	}
+	if pc.endpoint != "" {
+		// the --nohup child is the process that reports the attach result, so it needs the report settings too
+		if pc.endpointSecret != "" {
+			args = fmt.Sprintf("%s --endpoint-secret %s", args, pc.endpointSecret)
+		}
+		args = fmt.Sprintf("%s --endpoint-max-retries %d --endpoint-timeout %s", args, pc.endpointMaxRetries, pc.endpointTimeout)
+	}
 	response := channel.NewLocalChannel().Run(context.Background(), path.Join(util.GetProgramPath(), "blade"), args)
 	if response.Success {
 		logrus.Infof("attach java agent success, uid: %s", uid)
@@ -247,8 +412,8 @@ func (pc *PrepareJvmCommand) invokeAttaching(port string, uid string) {
   "type":"JAVA_AGENT_PREPARE"
 }
 */
-func createPostBody(uid string) ([]byte, error) {
-	preparationRecord, err := GetDS().QueryPreparationByUid(uid)
+func (pc *PrepareJvmCommand) createPostBody(uid string) ([]byte, error) {
+	preparationRecord, err := pc.store.QueryByUid(uid)
 	if err != nil {
 		return nil, err
 	}
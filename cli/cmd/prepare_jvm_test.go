@@ -0,0 +1,329 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chaosblade-io/chaosblade-spec-go/spec"
+
+	"github.com/chaosblade-io/chaosblade/data"
+)
+
+// mockJvmAttacher is a scripted JvmAttacher used to drive PrepareJvmCommand
+// without a real JVM process.
+type mockJvmAttacher struct {
+	pid          string
+	resolveErr   *spec.Response
+	attachCalls  []string
+	attachResult map[string]struct {
+		response *spec.Response
+		username string
+	}
+	checkPortResult string
+	checkPortErr    error
+
+	// attachContainerCalls records the ports AttachContainer was called with.
+	attachContainerCalls []string
+	// attachContainerResponse is returned by AttachContainer; defaults to success.
+	attachContainerResponse *spec.Response
+	// attachContainerFallbackPort, when set, simulates AttachInContainer's
+	// internal sandbox-token fallback having retried and succeeded on a
+	// different port, by invoking the updatePort callback with it.
+	attachContainerFallbackPort string
+}
+
+func (m *mockJvmAttacher) ResolvePID(processName, processId, containerRuntime, containerId string) (string, *spec.Response) {
+	if m.resolveErr != nil {
+		return "", m.resolveErr
+	}
+	return m.pid, spec.ReturnSuccess(m.pid)
+}
+
+func (m *mockJvmAttacher) Attach(port, javaHome, pid string) (*spec.Response, string) {
+	m.attachCalls = append(m.attachCalls, port)
+	if result, ok := m.attachResult[port]; ok {
+		return result.response, result.username
+	}
+	return spec.ReturnSuccess("attached"), "admin"
+}
+
+func (m *mockJvmAttacher) CheckPort(username string) (string, error) {
+	return m.checkPortResult, m.checkPortErr
+}
+
+func (m *mockJvmAttacher) AttachContainer(containerRuntime, containerId, port, javaHome, hostPid, uid string, updatePort func(uid, port string) error) *spec.Response {
+	m.attachContainerCalls = append(m.attachContainerCalls, port)
+	if m.attachContainerFallbackPort != "" {
+		if err := updatePort(uid, m.attachContainerFallbackPort); err != nil {
+			return spec.ReturnFail(spec.Code[spec.ServerError], err.Error())
+		}
+	}
+	if m.attachContainerResponse != nil {
+		return m.attachContainerResponse
+	}
+	return spec.ReturnSuccess("attached")
+}
+
+// mockPreparationStore is a scripted PreparationStore used to drive
+// PrepareJvmCommand without a real sqlite file.
+type mockPreparationStore struct {
+	queryRecord   *data.PreparationRecord
+	queryErr      error
+	insertRecord  *data.PreparationRecord
+	insertErr     error
+	updatedPorts  []string
+	updatedPids   []string
+	byUidRecord   *data.PreparationRecord
+	byUidErr      error
+	updatePortErr error
+}
+
+func (m *mockPreparationStore) Query(preType, processName, processId string) (*data.PreparationRecord, error) {
+	return m.queryRecord, m.queryErr
+}
+
+func (m *mockPreparationStore) Insert(preType, processName, port, processId string) (*data.PreparationRecord, error) {
+	return m.insertRecord, m.insertErr
+}
+
+func (m *mockPreparationStore) UpdatePort(uid, port string) error {
+	m.updatedPorts = append(m.updatedPorts, port)
+	return m.updatePortErr
+}
+
+func (m *mockPreparationStore) UpdatePid(uid, processId string) error {
+	m.updatedPids = append(m.updatedPids, processId)
+	return nil
+}
+
+func (m *mockPreparationStore) UpdateContainer(uid, containerId, processId string) error {
+	return nil
+}
+
+func (m *mockPreparationStore) QueryByUid(uid string) (*data.PreparationRecord, error) {
+	return m.byUidRecord, m.byUidErr
+}
+
+// newTestPrepareJvmCommand builds a PrepareJvmCommand wired to mocks and
+// points CHAOSBLADE_HOME at a scratch dir, since Init starts the real sqlite-
+// backed report flusher and prepareJvm's report path writes through it too.
+func newTestPrepareJvmCommand(t *testing.T, attacher *mockJvmAttacher, store *mockPreparationStore) *PrepareJvmCommand {
+	t.Setenv("CHAOSBLADE_HOME", t.TempDir())
+	pc := &PrepareJvmCommand{attacher: attacher, store: store}
+	pc.Init()
+	pc.processName = "tomcat"
+	return pc
+}
+
+func TestAttachAgent(t *testing.T) {
+	refused := spec.ReturnFail(spec.Code[spec.ServerError], "connection refused")
+
+	tests := []struct {
+		name         string
+		containerId  string
+		attachResult map[string]struct {
+			response *spec.Response
+			username string
+		}
+		checkPortResult             string
+		attachContainerFallbackPort string
+		wantAttachCalls             []string
+		wantAttachContainerCalls    []string
+		wantSuccess                 bool
+		wantUpdatedPort             string
+	}{
+		{
+			name:            "sync happy path attaches once and does not touch the port",
+			wantAttachCalls: []string{"8000"},
+			wantSuccess:     true,
+		},
+		{
+			name: "connection refused falls back to the sandbox token port",
+			attachResult: map[string]struct {
+				response *spec.Response
+				username string
+			}{
+				"8000": {response: refused, username: "admin"},
+				"8001": {response: spec.ReturnSuccess("attached"), username: "admin"},
+			},
+			checkPortResult: "8001",
+			wantAttachCalls: []string{"8000", "8001"},
+			wantSuccess:     true,
+			wantUpdatedPort: "8001",
+		},
+		{
+			name:                     "container sync happy path delegates to AttachContainer",
+			containerId:              "c1",
+			wantAttachContainerCalls: []string{"8000"},
+			wantSuccess:              true,
+		},
+		{
+			name:                        "container connection refused falls back to the sandbox token port",
+			containerId:                 "c1",
+			attachContainerFallbackPort: "8001",
+			wantAttachContainerCalls:    []string{"8000"},
+			wantSuccess:                 true,
+			wantUpdatedPort:             "8001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attacher := &mockJvmAttacher{
+				pid:                         "1",
+				attachResult:                tt.attachResult,
+				checkPortResult:             tt.checkPortResult,
+				attachContainerFallbackPort: tt.attachContainerFallbackPort,
+			}
+			store := &mockPreparationStore{}
+			pc := newTestPrepareJvmCommand(t, attacher, store)
+			pc.uid = "uid-1"
+			pc.port = 8000
+			pc.processId = "1"
+			pc.containerId = tt.containerId
+
+			response := pc.attachAgent()
+
+			if response.Success != tt.wantSuccess {
+				t.Fatalf("expected success=%v, got %v", tt.wantSuccess, response)
+			}
+			gotCalls, wantCalls := attacher.attachCalls, tt.wantAttachCalls
+			if tt.containerId != "" {
+				gotCalls, wantCalls = attacher.attachContainerCalls, tt.wantAttachContainerCalls
+			}
+			if len(gotCalls) != len(wantCalls) {
+				t.Fatalf("expected calls %v, got %v", wantCalls, gotCalls)
+			}
+			for i, port := range wantCalls {
+				if gotCalls[i] != port {
+					t.Fatalf("expected calls %v, got %v", wantCalls, gotCalls)
+				}
+			}
+			if tt.wantUpdatedPort == "" {
+				if len(store.updatedPorts) != 0 {
+					t.Fatalf("expected no port update, got %v", store.updatedPorts)
+				}
+			} else {
+				if len(store.updatedPorts) != 1 || store.updatedPorts[0] != tt.wantUpdatedPort {
+					t.Fatalf("expected the new port %s to be persisted, got %v", tt.wantUpdatedPort, store.updatedPorts)
+				}
+			}
+		})
+	}
+}
+
+func TestManualPreparation(t *testing.T) {
+	tests := []struct {
+		name         string
+		insertRecord *data.PreparationRecord
+		running      *data.PreparationRecord
+		async        bool
+		port         int
+		wantNilErr   bool
+		wantNilRec   bool
+		wantFailCode string
+	}{
+		{
+			name:         "async preparation returns immediately with a nil record",
+			insertRecord: &data.PreparationRecord{Uid: "uid-async", Port: "8000", Status: "Created"},
+			async:        true,
+			wantNilErr:   true,
+			wantNilRec:   true,
+		},
+		{
+			name:         "re-preparing with a different port conflicts",
+			running:      &data.PreparationRecord{Uid: "uid-1", Port: "8000", Status: "Running"},
+			port:         9000,
+			wantFailCode: spec.IllegalParameters,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attacher := &mockJvmAttacher{pid: "1"}
+			store := &mockPreparationStore{insertRecord: tt.insertRecord}
+			pc := newTestPrepareJvmCommand(t, attacher, store)
+			pc.async = tt.async
+			pc.port = tt.port
+			pc.processId = "1"
+
+			record, err := pc.ManualPreparation(tt.running, nil)
+
+			if tt.wantFailCode != "" {
+				response, ok := err.(*spec.Response)
+				if !ok || response.Code != spec.Code[tt.wantFailCode].Code {
+					t.Fatalf("expected %s failure, got err=%v record=%v", tt.wantFailCode, err, record)
+				}
+				return
+			}
+			if tt.wantNilErr && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if tt.wantNilRec && record != nil {
+				t.Fatalf("expected a nil record to break the sync flow, got %v", record)
+			}
+		})
+	}
+}
+
+// TestReportAttachedResult_EndpointFailureDoesNotMaskAttachSuccess calls
+// reportAttachedResult against a real httptest.Server that always answers
+// 500, so it's a genuine endpoint failure rather than an error manufactured
+// before a Reporter is ever built (a prior version of this test made
+// createPostBody fail instead, so reportAttachedResult never even reached
+// the network and the assertion held trivially). It stands alone, outside
+// the table-driven tests above, because it needs a live server and a channel
+// to observe the async delivery attempt rather than a single in-process
+// assertion.
+func TestReportAttachedResult_EndpointFailureDoesNotMaskAttachSuccess(t *testing.T) {
+	attempted := make(chan struct{}, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case attempted <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer endpoint.Close()
+
+	attacher := &mockJvmAttacher{pid: "1"}
+	store := &mockPreparationStore{
+		byUidRecord: &data.PreparationRecord{Uid: "uid-1", Port: "8000", Status: "Running"},
+	}
+	pc := newTestPrepareJvmCommand(t, attacher, store)
+	pc.uid = "uid-1"
+	pc.endpoint = endpoint.URL
+	pc.endpointMaxRetries = 1
+	pc.endpointTimeout = 500 * time.Millisecond
+
+	response := spec.ReturnSuccess("attached")
+	pc.reportAttachedResult(response)
+
+	if !response.Success {
+		t.Fatalf("a failed report must not flip the already-successful attach response, got %v", response)
+	}
+
+	select {
+	case <-attempted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the report endpoint to actually be contacted")
+	}
+}
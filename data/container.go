@@ -0,0 +1,91 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"database/sql"
+	"path"
+
+	"github.com/chaosblade-io/chaosblade-spec-go/util"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dbPath returns the sqlite file backing blade's local state, under CHAOSBLADE_HOME/lib.
+func dbPath() string {
+	return path.Join(util.GetLibHome(), "chaosblade.db")
+}
+
+// openDB opens the shared sqlite file. Callers are responsible for creating
+// whatever table(s) they own before using the handle.
+func openDB() (*sql.DB, error) {
+	return sql.Open("sqlite3", dbPath())
+}
+
+const createContainerBindingTableSql = `
+CREATE TABLE IF NOT EXISTS container_binding (
+	uid TEXT PRIMARY KEY,
+	container_id TEXT,
+	host_pid TEXT,
+	update_time TEXT
+)`
+
+// ContainerBinding records the container id and resolved host pid a jvm
+// prepare uid last attached inside, so a later prepare/destroy against the
+// same uid knows to re-enter that container's namespaces.
+type ContainerBinding struct {
+	Uid         string
+	ContainerId string
+	HostPid     string
+}
+
+// UpdatePreparationContainer upserts the container id and host pid bound to uid.
+func UpdatePreparationContainer(uid, containerId, hostPid string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createContainerBindingTableSql); err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO container_binding(uid, container_id, host_pid, update_time) VALUES (?, ?, ?, datetime('now'))
+		ON CONFLICT(uid) DO UPDATE SET container_id=excluded.container_id, host_pid=excluded.host_pid, update_time=excluded.update_time`,
+		uid, containerId, hostPid)
+	return err
+}
+
+// QueryPreparationContainer returns the container binding persisted for uid, or
+// nil if uid was never prepared against a container.
+func QueryPreparationContainer(uid string) (*ContainerBinding, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createContainerBindingTableSql); err != nil {
+		return nil, err
+	}
+	row := db.QueryRow(`SELECT uid, container_id, host_pid FROM container_binding WHERE uid = ?`, uid)
+	binding := &ContainerBinding{}
+	if err := row.Scan(&binding.Uid, &binding.ContainerId, &binding.HostPid); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return binding, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+const createPreparationReportTableSql = `
+CREATE TABLE IF NOT EXISTS preparation_report (
+	uid TEXT PRIMARY KEY,
+	endpoint TEXT,
+	body TEXT,
+	create_time TEXT
+)`
+
+// PreparationReport is an async attach-result report that hasn't been
+// confirmed delivered to its endpoint yet.
+type PreparationReport struct {
+	Uid      string
+	Endpoint string
+	Body     string
+}
+
+// InsertPreparationReport upserts the pending report body for uid, so it
+// survives a blade restart until delivery is confirmed.
+func InsertPreparationReport(uid, endpoint string, body []byte) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createPreparationReportTableSql); err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO preparation_report(uid, endpoint, body, create_time) VALUES (?, ?, ?, datetime('now'))
+		ON CONFLICT(uid) DO UPDATE SET endpoint=excluded.endpoint, body=excluded.body, create_time=excluded.create_time`,
+		uid, endpoint, string(body))
+	return err
+}
+
+// DeletePreparationReport removes the pending report for uid once delivery succeeds.
+func DeletePreparationReport(uid string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createPreparationReportTableSql); err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM preparation_report WHERE uid = ?`, uid)
+	return err
+}
+
+// QueryUndeliveredPreparationReports returns every report left undelivered by
+// a previous blade process, for the background flusher to retry.
+func QueryUndeliveredPreparationReports() ([]*PreparationReport, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createPreparationReportTableSql); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT uid, endpoint, body FROM preparation_report`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reports []*PreparationReport
+	for rows.Next() {
+		report := &PreparationReport{}
+		if err := rows.Scan(&report.Uid, &report.Endpoint, &report.Body); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jvm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/chaosblade-io/chaosblade-spec-go/channel"
+	"github.com/chaosblade-io/chaosblade-spec-go/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported --container-runtime values.
+const (
+	RuntimeDocker     = "docker"
+	RuntimeContainerd = "containerd"
+)
+
+// CheckContainerFlagValues resolves the host-side pid of the java process named
+// processName (or exactly matching processId, when given) running inside
+// containerId, using the docker or containerd client. It is the container
+// counterpart of CheckFlagValues.
+func CheckContainerFlagValues(containerRuntime, containerId, processName, processId string) (string, *spec.Response) {
+	if containerId == "" {
+		return "", spec.ReturnFail(spec.Code[spec.IllegalParameters], "less --container flag")
+	}
+	switch containerRuntime {
+	case "", RuntimeDocker:
+		return resolveDockerHostPid(containerId, processName, processId)
+	case RuntimeContainerd:
+		return resolveContainerdHostPid(containerId, processName, processId)
+	default:
+		return "", spec.ReturnFail(spec.Code[spec.IllegalParameters],
+			fmt.Sprintf("unsupported --container-runtime %s, expect docker or containerd", containerRuntime))
+	}
+}
+
+// resolveDockerHostPid lists the container's processes with `docker top`,
+// which reports host-side pids by design (docker resolves the container's pid
+// namespace for us) together with the full command line, and picks the java
+// process matching processName or processId out of the listing.
+func resolveDockerHostPid(containerId, processName, processId string) (string, *spec.Response) {
+	response := channel.NewLocalChannel().Run(context.Background(), "docker", fmt.Sprintf("top %s -eo pid,comm,args", containerId))
+	if !response.Success {
+		return "", spec.ReturnFail(spec.Code[spec.ServerError],
+			fmt.Sprintf("list processes in container %s failed, %s", containerId, response.Err))
+	}
+	listing, _ := response.Result.(string)
+	pid, found := pickJavaPid(listing, processName, processId)
+	if !found {
+		return "", spec.ReturnFail(spec.Code[spec.ServerError],
+			fmt.Sprintf("no java process matching %q %q found in container %s", processName, processId, containerId))
+	}
+	return pid, spec.ReturnSuccess(pid)
+}
+
+// resolveContainerdHostPid lists the container's host-side pids with
+// `ctr task ps`, which — unlike `docker top` — prints no command line, so
+// processName alone can't be matched off that listing. It matches processId
+// directly against the pid list, and otherwise reads each candidate's
+// /proc/<pid>/cmdline (which ctr's reported host pid makes visible from the
+// host) to find the one java process matching processName.
+func resolveContainerdHostPid(containerId, processName, processId string) (string, *spec.Response) {
+	response := channel.NewLocalChannel().Run(context.Background(), "ctr", fmt.Sprintf("task ps %s", containerId))
+	if !response.Success {
+		return "", spec.ReturnFail(spec.Code[spec.ServerError],
+			fmt.Sprintf("list processes in container %s failed, %s", containerId, response.Err))
+	}
+	listing, _ := response.Result.(string)
+	pids := parseContainerdPids(listing)
+	if processId != "" {
+		for _, pid := range pids {
+			if pid == processId {
+				return pid, spec.ReturnSuccess(pid)
+			}
+		}
+	} else if processName != "" {
+		for _, pid := range pids {
+			cmdline, err := readProcCmdline(pid)
+			if err != nil {
+				continue
+			}
+			if strings.Contains(cmdline, "java") && strings.Contains(cmdline, processName) {
+				return pid, spec.ReturnSuccess(pid)
+			}
+		}
+	}
+	return "", spec.ReturnFail(spec.Code[spec.ServerError],
+		fmt.Sprintf("no java process matching %q %q found in container %s", processName, processId, containerId))
+}
+
+// parseContainerdPids extracts the host-side pid column from a `ctr task ps`
+// listing, skipping its "PID ... INFO" header line.
+func parseContainerdPids(listing string) []string {
+	var pids []string
+	for i, line := range strings.Split(strings.TrimSpace(listing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if i == 0 && strings.EqualFold(fields[0], "PID") {
+			continue
+		}
+		pids = append(pids, fields[0])
+	}
+	return pids
+}
+
+// readProcCmdline reads /proc/<pid>/cmdline on the host (ctr reports host-side
+// pids, so this is visible without entering the container) and turns its
+// NUL-separated argv into a space-separated command line.
+func readProcCmdline(pid string) (string, error) {
+	response := channel.NewLocalChannel().Run(context.Background(), "cat", fmt.Sprintf("/proc/%s/cmdline", pid))
+	if !response.Success {
+		return "", fmt.Errorf("read /proc/%s/cmdline failed, %s", pid, response.Err)
+	}
+	cmdline, _ := response.Result.(string)
+	return strings.Join(strings.FieldsFunc(cmdline, func(r rune) bool { return r == 0 }), " "), nil
+}
+
+// pickJavaPid scans the lines of a `docker top` listing (pid as the first
+// column, followed by the command line) for the line whose pid equals processId, or whose command
+// line mentions both "java" and processName, and returns its host pid.
+func pickJavaPid(listing, processName, processId string) (string, bool) {
+	lines := strings.Split(strings.TrimSpace(listing), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		pid := fields[0]
+		commandLine := strings.Join(fields[1:], " ")
+		if processId != "" && pid == processId {
+			return pid, true
+		}
+		if processName != "" && strings.Contains(commandLine, "java") && strings.Contains(commandLine, processName) {
+			return pid, true
+		}
+	}
+	return "", false
+}
+
+// AttachInContainer enters hostPid's mount and pid namespaces via nsenter, then
+// issues the attach from inside, so the agent socket file is created in the
+// container's filesystem where the JVM can see it. It does not copy the sandbox
+// jar into the container; see attachArgs for the path it runs. The
+// sandbox-token port fallback and its retry also run inside the container
+// namespace for the same reason.
+func AttachInContainer(containerRuntime, containerId, port, javaHome, hostPid, uid string, updatePort func(uid, port string) error) *spec.Response {
+	response, username := attachInNamespace(hostPid, port, javaHome, hostPid)
+	if !response.Success && username != "" && strings.Contains(response.Err, "connection refused") {
+		tokenPort, err := checkPortFromSandboxTokenInNamespace(hostPid, username)
+		if err == nil {
+			logrus.Infof("use %s port to retry inside container %s", tokenPort, containerId)
+			response, username = attachInNamespace(hostPid, tokenPort, javaHome, hostPid)
+			if response.Success {
+				if err := updatePort(uid, tokenPort); err != nil {
+					logrus.Warningf("update preparation port failed, %v", err)
+				}
+			}
+		}
+	}
+	return response
+}
+
+// attachInNamespace runs the same attach that Attach performs, but wrapped in
+// nsenter so it executes inside the mount and pid namespaces of nsTargetPid.
+func attachInNamespace(nsTargetPid, port, javaHome, pid string) (*spec.Response, string) {
+	nsenterArgs := fmt.Sprintf("--target %s --mount --pid -- %s", nsTargetPid, attachArgs(port, javaHome, pid))
+	response := channel.NewLocalChannel().Run(context.Background(), "nsenter", nsenterArgs)
+	username := ""
+	if !response.Success {
+		username = extractUsername(response.Err)
+	}
+	return response, username
+}
+
+// attachArgs builds the command used to issue the attach, mirroring the
+// invocation the host-side attach uses. It names sandbox-core-bootstrap.jar by a
+// relative path, which has to resolve inside the container's mount namespace.
+func attachArgs(port, javaHome, pid string) string {
+	cmd := fmt.Sprintf("java -jar sandbox-core-bootstrap.jar -p %s -m attach", pid)
+	if port != "" {
+		cmd = fmt.Sprintf("%s --agent-port %s", cmd, port)
+	}
+	if javaHome != "" {
+		cmd = fmt.Sprintf("JAVA_HOME=%s %s", javaHome, cmd)
+	}
+	return cmd
+}
+
+// homeDirInNamespace returns the home directory the sandbox token is written
+// under for username. root's home is /root rather than /home/root, which a
+// containerized java process commonly runs as, so it can't be derived by
+// just formatting /home/<user> the way every other user's can.
+func homeDirInNamespace(username string) string {
+	if username == "root" {
+		return "/root"
+	}
+	return fmt.Sprintf("/home/%s", username)
+}
+
+// extractUsername pulls the "as user <name>" hint an attach failure message
+// carries, e.g. "attach failed as user admin: connection refused", so the
+// sandbox-token fallback knows whose token file to read.
+func extractUsername(errMsg string) string {
+	const marker = "as user "
+	idx := strings.Index(errMsg, marker)
+	if idx < 0 {
+		return ""
+	}
+	rest := errMsg[idx+len(marker):]
+	if sep := strings.IndexAny(rest, " :"); sep >= 0 {
+		return rest[:sep]
+	}
+	return rest
+}
+
+// checkPortFromSandboxTokenInNamespace looks up ~/.sandbox.token for username
+// inside nsTargetPid's mount namespace, since the token file lives in the
+// container's filesystem, not the host's.
+func checkPortFromSandboxTokenInNamespace(nsTargetPid, username string) (string, error) {
+	nsenterArgs := fmt.Sprintf("--target %s --mount -- cat %s/.sandbox.token", nsTargetPid, homeDirInNamespace(username))
+	response := channel.NewLocalChannel().Run(context.Background(), "nsenter", nsenterArgs)
+	if !response.Success {
+		return "", fmt.Errorf("read sandbox token in container namespace failed, %s", response.Err)
+	}
+	token, _ := response.Result.(string)
+	fields := strings.Split(strings.TrimSpace(token), ";")
+	if len(fields) == 0 || fields[0] == "" {
+		return "", fmt.Errorf("empty sandbox token")
+	}
+	return fields[0], nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jvm
+
+import "testing"
+
+func TestPickJavaPid(t *testing.T) {
+	const listing = "PID   COMMAND   ARGS\n" +
+		"101   java      java -jar tomcat.jar\n" +
+		"202   bash      -bash\n"
+
+	tests := []struct {
+		name        string
+		processName string
+		processId   string
+		wantPid     string
+		wantFound   bool
+	}{
+		{name: "matches by pid", processId: "202", wantPid: "202", wantFound: true},
+		{name: "matches by process name", processName: "tomcat", wantPid: "101", wantFound: true},
+		{name: "no match", processName: "nginx", wantFound: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, found := pickJavaPid(listing, tt.processName, tt.processId)
+			if found != tt.wantFound || pid != tt.wantPid {
+				t.Fatalf("expected (%q, %v), got (%q, %v)", tt.wantPid, tt.wantFound, pid, found)
+			}
+		})
+	}
+}
+
+func TestParseContainerdPids(t *testing.T) {
+	const listing = "PID     STATUS\n" +
+		"101     RUNNING\n" +
+		"202     RUNNING\n"
+
+	pids := parseContainerdPids(listing)
+	want := []string{"101", "202"}
+	if len(pids) != len(want) {
+		t.Fatalf("expected pids %v, got %v", want, pids)
+	}
+	for i, pid := range want {
+		if pids[i] != pid {
+			t.Fatalf("expected pids %v, got %v", want, pids)
+		}
+	}
+}
+
+func TestExtractUsername(t *testing.T) {
+	tests := []struct {
+		name   string
+		errMsg string
+		want   string
+	}{
+		{name: "user followed by colon", errMsg: "attach failed as user admin: connection refused", want: "admin"},
+		{name: "user at end of message", errMsg: "attach failed as user admin", want: "admin"},
+		{name: "no user hint", errMsg: "connection refused", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractUsername(tt.errMsg); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHomeDirInNamespace(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{username: "root", want: "/root"},
+		{username: "admin", want: "/home/admin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			if got := homeDirInNamespace(tt.username); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
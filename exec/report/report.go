@@ -0,0 +1,172 @@
+/*
+ * Copyright 1999-2020 Alibaba Group Holding Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package report implements reliable delivery of async command callbacks to a
+// controller endpoint. It is shared by any command that can run asynchronously
+// and needs to report its result back, not just `prepare jvm`.
+package report
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/chaosblade-io/chaosblade/data"
+)
+
+// SignatureHeader carries the HMAC-SHA256 signature of the request body, hex encoded.
+const SignatureHeader = "X-Chaosblade-Signature"
+
+// EndpointSecretEnvKey is the fallback env var used to sign reports when --endpoint-secret is empty.
+const EndpointSecretEnvKey = "CHAOSBLADE_ENDPOINT_SECRET"
+
+const (
+	defaultMaxRetries = 5
+	defaultTimeout    = 10 * time.Second
+	baseBackoff       = 500 * time.Millisecond
+)
+
+// Config controls how a Reporter delivers a report to a controller endpoint.
+type Config struct {
+	Endpoint   string
+	Secret     string
+	MaxRetries int
+	Timeout    time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.Secret == "" {
+		c.Secret = os.Getenv(EndpointSecretEnvKey)
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	return c
+}
+
+// Reporter delivers JSON report bodies to a controller endpoint, retrying with
+// exponential backoff and jitter, signing the body with HMAC-SHA256, and
+// persisting undelivered reports so a blade restart doesn't lose them.
+type Reporter struct {
+	config Config
+}
+
+// NewReporter creates a Reporter for the given endpoint configuration.
+func NewReporter(config Config) *Reporter {
+	return &Reporter{config: config.withDefaults()}
+}
+
+// Deliver persists the report under uid synchronously — so it survives even if
+// the caller (e.g. `prepare jvm --nohup`) exits right after this call returns —
+// then retries delivery in the background. Callers that need the attempt
+// itself to finish before returning should wait on the returned channel.
+func (r *Reporter) Deliver(uid string, body []byte) <-chan struct{} {
+	if err := data.InsertPreparationReport(uid, r.config.Endpoint, body); err != nil {
+		logrus.Warningf("persist preparation report %s failed, %v", uid, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if r.send(body) {
+			if err := data.DeletePreparationReport(uid); err != nil {
+				logrus.Warningf("delete delivered preparation report %s failed, %v", uid, err)
+			}
+		}
+	}()
+	return done
+}
+
+// Flush retries every preparation report left undelivered by a previous blade
+// process, e.g. after a restart or crash during delivery.
+func Flush() {
+	pending, err := data.QueryUndeliveredPreparationReports()
+	if err != nil {
+		logrus.Warningf("query undelivered preparation reports failed, %v", err)
+		return
+	}
+	for _, p := range pending {
+		<-NewReporter(Config{Endpoint: p.Endpoint, Secret: os.Getenv(EndpointSecretEnvKey)}).Deliver(p.Uid, []byte(p.Body))
+	}
+}
+
+// StartFlusher runs Flush immediately, then again on the given interval until
+// the process exits, so reports that failed to deliver get a chance to drain
+// in the background. Flushing immediately matters because most blade
+// invocations are short-lived one-shot commands that exit well before the
+// first tick of a plain ticker would ever fire.
+func StartFlusher(interval time.Duration) {
+	go func() {
+		Flush()
+		for range time.Tick(interval) {
+			Flush()
+		}
+	}()
+}
+
+func (r *Reporter) send(body []byte) bool {
+	backoff := baseBackoff
+	for attempt := 0; attempt <= r.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+			backoff *= 2
+		}
+		success, retryable := r.attempt(body)
+		if success || !retryable {
+			return success
+		}
+	}
+	return false
+}
+
+func (r *Reporter) attempt(body []byte) (success bool, retryable bool) {
+	req, err := http.NewRequest(http.MethodPost, r.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		logrus.Warningf("build report request to %s failed, %v", r.config.Endpoint, err)
+		return false, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.config.Secret != "" {
+		req.Header.Set(SignatureHeader, sign(r.config.Secret, body))
+	}
+	client := &http.Client{Timeout: r.config.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		logrus.Warningf("deliver report to %s failed, %v", r.config.Endpoint, err)
+		return false, true
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return true, false
+	}
+	logrus.Warningf("report endpoint %s responded with status %d", r.config.Endpoint, resp.StatusCode)
+	return false, resp.StatusCode >= 500
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}